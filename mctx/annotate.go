@@ -140,6 +140,11 @@ func (aa Annotations) StringSlice(sorted bool) [][2]string {
 // For convenience the passed in Annotations is returned from this function, and
 // if nil is given as the Annotations value then an Annotations will be
 // allocated and returned.
+//
+// Annotating a Context never modifies it, but instead returns a new Context,
+// so the returned Annotations are a snapshot which is unaffected by any
+// subsequent annotating, and which is safe to read from other goroutines. The
+// annotations of the Context's ancestors are always included.
 func EvaluateAnnotations(ctx context.Context, aa Annotations) Annotations {
 	if aa == nil {
 		aa = Annotations{}
@@ -159,12 +164,35 @@ func EvaluateAnnotations(ctx context.Context, aa Annotations) Annotations {
 	return aa
 }
 
+// Annotation returns the value of the annotation with the given key which was
+// set via Annotate(With) on this Context or its ancestors, exactly as it was
+// given. If the key was set twice then the most recent value is returned. If
+// the key was never set then false is returned.
 //
+// Unlike EvaluateAnnotations, Annotators which were set prior to the one which
+// produced the key are not evaluated.
+func Annotation(ctx context.Context, key interface{}) (interface{}, bool) {
+	tmp := Annotations{}
+	for el, _ := ctx.Value(ctxKeyAnnotation(0)).(*el); el != nil; el = el.prev {
+		el.annotator.Annotate(tmp)
+		if v, ok := tmp[key]; ok {
+			return v, true
+		}
+		for k := range tmp {
+			delete(tmp, k)
+		}
+	}
+	return nil, false
+}
+
 // MergeAnnotations sequentially merges the annotation data of the passed in
 // Contexts into the first passed in Context. Data from a Context overwrites
 // overlapping data on all passed in Contexts to the left of it. All other
 // aspects of the first Context remain the same, and that Context is returned
 // with the new set of Annotation data.
+//
+// None of the passed in Contexts are modified; the returned Context is a new
+// one derived from the first.
 func MergeAnnotations(ctx context.Context, ctxs ...context.Context) context.Context {
 	aa := Annotations{}
 	tmp := Annotations{}
@@ -176,9 +204,25 @@ func MergeAnnotations(ctx context.Context, ctxs ...context.Context) context.Cont
 			delete(tmp, k)
 		}
 	}
+	return replaceAnnotations(ctx, aa)
+}
+
+func replaceAnnotations(ctx context.Context, aa Annotations) context.Context {
 	return context.WithValue(ctx, ctxKeyAnnotation(0), &el{annotator: aa})
 }
 
+// ReplaceAnnotations returns a copy of the Context whose annotations are only
+// those in the given Annotations, discarding any which were set on the Context
+// or its ancestors. All other aspects of the Context remain the same.
+//
+// The given Annotations are copied, so modifying them afterwards does not
+// affect the returned Context.
+func ReplaceAnnotations(ctx context.Context, aa Annotations) context.Context {
+	aaCopy := make(Annotations, len(aa))
+	aa.Annotate(aaCopy)
+	return replaceAnnotations(ctx, aaCopy)
+}
+
 type ctxAnnotator struct {
 	ctx context.Context
 }
@@ -2,6 +2,7 @@ package mctx
 
 import (
 	"context"
+	"sync"
 	. "testing"
 
 	"github.com/mediocregopher/mediocre-go-lib/v2/mtest/massert"
@@ -68,4 +69,78 @@ func TestMergeAnnotations(t *T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// the passed in Contexts are not modified
+	massert.Require(t,
+		massert.Equal(
+			Annotations{0: "ZERO", 1: "one"},
+			EvaluateAnnotations(ctxA, nil),
+		),
+		massert.Equal(
+			Annotations{1: "ONE", 2: "TWO"},
+			EvaluateAnnotations(ctxB, nil),
+		),
+	)
+}
+
+func TestReplaceAnnotations(t *T) {
+	type ctxKey int
+	ctx := context.WithValue(context.Background(), ctxKey(0), "val")
+	ctx = Annotate(ctx, "a", "foo", "b", "bar")
+	aa := Annotations{"c": "baz"}
+	ctx = ReplaceAnnotations(ctx, aa)
+
+	// modifying the given Annotations doesn't affect the Context
+	aa["c"] = "BAZ"
+	aa["d"] = "buz"
+
+	massert.Require(t,
+		massert.Equal(Annotations{"c": "baz"}, EvaluateAnnotations(ctx, nil)),
+		massert.Equal("val", ctx.Value(ctxKey(0))),
+	)
+}
+
+func TestAnnotation(t *T) {
+	type userKey int
+	type user struct{ ID int }
+
+	ctx := context.Background()
+	ctx = Annotate(ctx, "a", 1, userKey(0), user{ID: 1})
+	ctx = Annotate(ctx, "a", 2)
+	ctx = WithAnnotator(ctx, testAnnotator{"b", "bar"})
+
+	assertAnnotation := func(key, expVal interface{}, expOK bool) massert.Assertion {
+		val, ok := Annotation(ctx, key)
+		return massert.All(
+			massert.Equal(expVal, val),
+			massert.Equal(expOK, ok),
+		)
+	}
+
+	massert.Require(t,
+		assertAnnotation("a", 2, true),
+		assertAnnotation("b", "bar", true),
+		assertAnnotation(userKey(0), user{ID: 1}, true),
+		assertAnnotation("c", nil, false),
+		assertAnnotation(userKey(1), nil, false),
+	)
+}
+
+func TestEvaluateAnnotationsParallel(t *T) {
+	ctx := Annotate(context.Background(), "a", "foo")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			childCtx := Annotate(ctx, "b", i)
+			aa := EvaluateAnnotations(childCtx, nil)
+			massert.Assert(t, massert.Equal(Annotations{"a": "foo", "b": i}, aa))
+		}(i)
+	}
+
+	aa := EvaluateAnnotations(ctx, nil)
+	wg.Wait()
+	massert.Require(t, massert.Equal(Annotations{"a": "foo"}, aa))
 }
@@ -24,6 +24,12 @@ func newStacktrace(skip int) Stacktrace {
 	return Stacktrace{frames: stackSlice[:l]}
 }
 
+// NewStacktrace returns the Stacktrace of the calling function, omitting the
+// given number of additional frames from the top of it.
+func NewStacktrace(skip int) Stacktrace {
+	return newStacktrace(skip + 1)
+}
+
 // Frame returns the first frame in the stack.
 func (s Stacktrace) Frame() runtime.Frame {
 	if len(s.frames) == 0 {
@@ -0,0 +1,216 @@
+package mlog
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
+)
+
+var processAnnotations struct {
+	once     sync.Once
+	hostname string
+	pid      int
+}
+
+// ProcessAnnotations returns Annotations describing the current process, namely
+// its "hostname" and "pid". These are only resolved once, the first time
+// ProcessAnnotations is called. If the hostname can't be resolved then
+// "unknown" is used.
+//
+// The returned Annotations can be attached to a Context using
+// mctx.WithAnnotator, so that they're included in all messages logged with
+// that Context.
+func ProcessAnnotations() mctx.Annotations {
+	p := &processAnnotations
+	p.once.Do(func() {
+		var err error
+		if p.hostname, err = os.Hostname(); err != nil || p.hostname == "" {
+			p.hostname = "unknown"
+		}
+		p.pid = os.Getpid()
+	})
+
+	return mctx.Annotations{
+		"hostname": p.hostname,
+		"pid":      p.pid,
+	}
+}
+
+// EnvAnnotations returns Annotations populated from environment variables. The
+// given mapping is of annotation key to the name of the environment variable
+// whose value should be used. The environment variables are read when
+// EnvAnnotations is called; any which are unset or empty are omitted.
+//
+// Like those from ProcessAnnotations, the returned Annotations are meant to be
+// attached to a Context using mctx.WithAnnotator.
+func EnvAnnotations(mapping map[string]string) mctx.Annotations {
+	aa := make(mctx.Annotations, len(mapping))
+	for key, envVar := range mapping {
+		if val := os.Getenv(envVar); val != "" {
+			aa[key] = val
+		}
+	}
+	return aa
+}
+
+// maxFlattenDepth is the maximum depth FlattenAnnotations will descend to. It
+// protects against cycles which can't be detected, e.g. those created by
+// Annotators.
+const maxFlattenDepth = 32
+
+// maxFlattenItems is the maximum total number of nested values
+// FlattenAnnotations will expand. It bounds the size of the result when values
+// nest widely, e.g. Annotators which produce new values on every evaluation.
+const maxFlattenItems = 4096
+
+// FlattenAnnotations returns a copy of the given Annotations in which any
+// value which is itself a set of annotations has been expanded into its
+// individual key/values, recursively, with their keys prefixed by the parent
+// key and a period. For example, the annotation "user" with value
+// map[string]interface{}{"id": 1} becomes the annotation "user.id" with value
+// 1.
+//
+// Values which are expanded are those of type mctx.Annotations,
+// map[string]interface{}, map[string]string, and any other mctx.Annotator,
+// which is evaluated to obtain its annotations. All other values are left as-is.
+//
+// If a cycle is encountered then the value at which it was detected is
+// replaced with the string "<cycle>". If expanding a value would take the total
+// number of expanded values past an internal limit then that value is replaced
+// with the string "<truncated>" instead.
+//
+// If a flattened key is the same as another key then the one which was nested
+// less deeply wins, so keys set directly in the given Annotations always win
+// over flattened ones. Remaining ties are won by the key whose sequence of
+// original keys, formatted using fmt.Sprint, sorts first.
+func FlattenAnnotations(aa mctx.Annotations) mctx.Annotations {
+	out := make(mctx.Annotations, len(aa))
+
+	pending := make([]flattenItem, 0, len(aa))
+	for k, v := range aa {
+		pending = append(pending, flattenItem{
+			key:  k,
+			path: []string{fmt.Sprint(k)},
+			v:    v,
+		})
+	}
+
+	// each depth is handled fully before the next, so that less deeply nested
+	// keys are always set first.
+	var expanded int
+	for depth := 0; len(pending) > 0; depth++ {
+		sort.Slice(pending, func(i, j int) bool {
+			return pathLess(pending[i].path, pending[j].path)
+		})
+
+		var next []flattenItem
+		for _, item := range pending {
+			next = item.flattenInto(out, next, depth, &expanded)
+		}
+		pending = next
+	}
+
+	return out
+}
+
+type flattenItem struct {
+	key       interface{}
+	path      []string
+	v         interface{}
+	ancestors []uintptr
+}
+
+func pathLess(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func setIfUnset(out mctx.Annotations, key, v interface{}) {
+	if _, ok := out[key]; !ok {
+		out[key] = v
+	}
+}
+
+// flattenInto sets the item's value on out if it isn't nested, or otherwise
+// appends the item's nested values to next and returns it. expanded tracks the
+// total number of nested values appended so far, across all calls.
+func (item flattenItem) flattenInto(out mctx.Annotations, next []flattenItem, depth int, expanded *int) []flattenItem {
+	nested, ptr, ok := nestedAnnotations(item.v)
+	if !ok {
+		setIfUnset(out, item.key, item.v)
+		return next
+	} else if depth >= maxFlattenDepth {
+		setIfUnset(out, item.key, "<cycle>")
+		return next
+	}
+
+	ancestors := item.ancestors
+	if ptr != 0 {
+		for _, ancestor := range ancestors {
+			if ancestor == ptr {
+				setIfUnset(out, item.key, "<cycle>")
+				return next
+			}
+		}
+		ancestors = append(ancestors[:len(ancestors):len(ancestors)], ptr)
+	}
+
+	if *expanded+len(nested) > maxFlattenItems {
+		setIfUnset(out, item.key, "<truncated>")
+		return next
+	}
+	*expanded += len(nested)
+
+	prefix := fmt.Sprint(item.key) + "."
+	for k, v := range nested {
+		kStr := fmt.Sprint(k)
+		next = append(next, flattenItem{
+			key:       prefix + kStr,
+			path:      append(item.path[:len(item.path):len(item.path)], kStr),
+			v:         v,
+			ancestors: ancestors,
+		})
+	}
+	return next
+}
+
+// nestedAnnotations returns the annotations nested within the given value, if
+// any, as well as a pointer identifying the value if it is a map or pointer.
+func nestedAnnotations(v interface{}) (mctx.Annotations, uintptr, bool) {
+	var ptr uintptr
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Map, reflect.Ptr:
+		ptr = rv.Pointer()
+	}
+
+	switch v := v.(type) {
+	case mctx.Annotations:
+		return v, ptr, true
+	case map[string]interface{}:
+		aa := make(mctx.Annotations, len(v))
+		for k, v := range v {
+			aa[k] = v
+		}
+		return aa, ptr, true
+	case map[string]string:
+		aa := make(mctx.Annotations, len(v))
+		for k, v := range v {
+			aa[k] = v
+		}
+		return aa, ptr, true
+	case mctx.Annotator:
+		aa := mctx.Annotations{}
+		v.Annotate(aa)
+		return aa, ptr, true
+	default:
+		return nil, 0, false
+	}
+}
@@ -0,0 +1,126 @@
+package mlog
+
+import (
+	"context"
+	"os"
+	. "testing"
+
+	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/v2/mtest/massert"
+)
+
+func TestProcessAnnotations(t *T) {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "unknown"
+	}
+
+	ctx := mctx.WithAnnotator(context.Background(), ProcessAnnotations())
+	massert.Require(t, massert.Equal(
+		mctx.Annotations{"hostname": hostname, "pid": os.Getpid()},
+		mctx.EvaluateAnnotations(ctx, nil),
+	))
+}
+
+type selfAnnotator struct{}
+
+func (s *selfAnnotator) Annotate(aa mctx.Annotations) {
+	aa["a"] = s
+	aa["b"] = s
+}
+
+// wideAnnotator produces a new value for each of its keys on every evaluation,
+// so its expansion can only be bounded by limiting the number of items.
+type wideAnnotator struct{}
+
+func (wideAnnotator) Annotate(aa mctx.Annotations) {
+	aa["a"] = wideAnnotator{}
+	aa["b"] = wideAnnotator{}
+}
+
+func TestFlattenAnnotations(t *T) {
+	cyclic := map[string]interface{}{"a": 1}
+	cyclic["self"] = cyclic
+
+	errCtx := mctx.Annotate(context.Background(), "reqID", "abc")
+
+	aa := mctx.Annotations{
+		"scalar": "foo",
+		1:        2,
+		"user": map[string]interface{}{
+			"id":   1,
+			"name": "bob",
+			"meta": map[string]string{"role": "admin"},
+		},
+		"aa":     mctx.Annotations{"x": "y"},
+		"errCtx": mctx.ContextAsAnnotator(errCtx),
+		"cyclic": cyclic,
+	}
+
+	massert.Require(t, massert.Equal(mctx.Annotations{
+		"scalar":         "foo",
+		1:                2,
+		"user.id":        1,
+		"user.name":      "bob",
+		"user.meta.role": "admin",
+		"aa.x":           "y",
+		"errCtx.reqID":   "abc",
+		"cyclic.a":       1,
+		"cyclic.self":    "<cycle>",
+	}, FlattenAnnotations(aa)))
+
+	massert.Require(t, massert.Equal(mctx.Annotations{
+		"x.a": "<cycle>",
+		"x.b": "<cycle>",
+	}, FlattenAnnotations(mctx.Annotations{"x": &selfAnnotator{}})))
+
+	wide := FlattenAnnotations(mctx.Annotations{"x": wideAnnotator{}})
+	massert.Require(t,
+		massert.Not(massert.Length(wide, 0)),
+		massert.Equal(true, len(wide) <= maxFlattenItems),
+	)
+	for k, v := range wide {
+		massert.Require(t, massert.Comment(
+			massert.Equal("<truncated>", v), "key %q", k,
+		))
+	}
+
+	// keys set directly win over flattened ones, and remaining ties go to the
+	// key whose original keys sort first.
+	for i := 0; i < 10; i++ {
+		aa := mctx.Annotations{
+			"user.id": "direct",
+			"user":    map[string]interface{}{"id": "flattened"},
+			"a.b":     map[string]interface{}{"c": "from a.b"},
+			"a":       map[string]interface{}{"b.c": "from a"},
+			"x": map[string]interface{}{
+				"y.z": "shallow",
+				"y":   map[string]interface{}{"z": "deep"},
+			},
+		}
+		massert.Require(t, massert.Equal(mctx.Annotations{
+			"user.id": "direct",
+			"a.b.c":   "from a",
+			"x.y.z":   "shallow",
+		}, FlattenAnnotations(aa)))
+	}
+}
+
+func TestEnvAnnotations(t *T) {
+	massert.Require(t,
+		massert.Nil(os.Setenv("MLOG_TEST_REGION", "us-east")),
+		massert.Nil(os.Setenv("MLOG_TEST_EMPTY", "")),
+		massert.Nil(os.Unsetenv("MLOG_TEST_UNSET")),
+	)
+	defer os.Unsetenv("MLOG_TEST_REGION")
+	defer os.Unsetenv("MLOG_TEST_EMPTY")
+
+	massert.Require(t, massert.Equal(
+		mctx.Annotations{"region": "us-east"},
+		EnvAnnotations(map[string]string{
+			"region": "MLOG_TEST_REGION",
+			"empty":  "MLOG_TEST_EMPTY",
+			"unset":  "MLOG_TEST_UNSET",
+		}),
+	))
+}
@@ -0,0 +1,300 @@
+package mlog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
+)
+
+type filterMessageHandler struct {
+	MessageHandler
+	keep func(FullMessage) bool
+}
+
+// NewFilterMessageHandler returns a MessageHandler which will only pass
+// messages on to the given MessageHandler if the keep function returns true
+// for them. The keep function is given the FullMessage, and so can inspect its
+// Level, Description, annotations, etc...
+//
+// When used with a Logger, keep is only called for messages which have already
+// passed the Logger's MaxLevel check.
+func NewFilterMessageHandler(h MessageHandler, keep func(FullMessage) bool) MessageHandler {
+	return &filterMessageHandler{MessageHandler: h, keep: keep}
+}
+
+func (h *filterMessageHandler) Handle(msg FullMessage) error {
+	if !h.keep(msg) {
+		return nil
+	}
+	return h.MessageHandler.Handle(msg)
+}
+
+type dedupeEntry struct {
+	msg     FullMessage
+	repeats int
+	timer   *time.Timer
+}
+
+type dedupeMessageHandler struct {
+	MessageHandler
+	window time.Duration
+
+	l    sync.Mutex
+	seen map[string]*dedupeEntry
+}
+
+// NewDedupeMessageHandler returns a MessageHandler which collapses identical
+// messages seen within the given window of time into a single message. Two
+// messages are identical if their Level, Namespace, Description, and
+// annotations all format to the same strings.
+//
+// The first instance of a message is passed on to the given MessageHandler
+// immediately. If any identical messages are seen within the window following
+// it, then once the window closes a single copy of the most recent one is
+// passed on, with " (repeated N times)" appended to its Description. Errors
+// returned from handling these summary messages are discarded.
+//
+// If the given MessageHandler returns an error for the first instance of a
+// message then no window is opened for it, and the error is returned.
+//
+// Calling Sync on the returned MessageHandler will immediately pass on the
+// summaries of all open windows, prior to calling Sync on the given
+// MessageHandler. All summaries are passed on and Sync is always called, even
+// if errors are encountered, with the first error being returned.
+func NewDedupeMessageHandler(h MessageHandler, window time.Duration) MessageHandler {
+	return &dedupeMessageHandler{
+		MessageHandler: h,
+		window:         window,
+		seen:           map[string]*dedupeEntry{},
+	}
+}
+
+func dedupeKey(msg FullMessage) string {
+	sb := new(strings.Builder)
+	fmt.Fprintf(sb, "%s\x00%d\x00%q\x00%s",
+		msg.Level.String(), msg.Level.Int(), msg.Namespace, msg.Description)
+	for _, kv := range mctx.EvaluateAnnotations(msg.Context, nil).StringSlice(true) {
+		fmt.Fprintf(sb, "\x00%s=%s", kv[0], kv[1])
+	}
+	return sb.String()
+}
+
+func (e *dedupeEntry) summary() FullMessage {
+	msg := e.msg
+	msg.Description = fmt.Sprintf("%s (repeated %d times)", msg.Description, e.repeats)
+	return msg
+}
+
+func (h *dedupeMessageHandler) Handle(msg FullMessage) error {
+	key := dedupeKey(msg)
+
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if e, ok := h.seen[key]; ok {
+		e.msg = msg
+		e.repeats++
+		return nil
+	}
+
+	// the first instance is handled, while holding the lock, prior to the
+	// window's timer being started, so that its summary can't be handled
+	// before it. If it couldn't be handled then no window is opened, so that
+	// the next instance is attempted as well.
+	if err := h.MessageHandler.Handle(msg); err != nil {
+		return err
+	}
+
+	e := new(dedupeEntry)
+	e.timer = time.AfterFunc(h.window, func() { h.expire(key, e) })
+	h.seen[key] = e
+	return nil
+}
+
+func (h *dedupeMessageHandler) expire(key string, e *dedupeEntry) {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	if h.seen[key] != e {
+		// the entry was already flushed by Sync
+		return
+	}
+	delete(h.seen, key)
+
+	// the summary is handled while holding the lock so that it's guaranteed to
+	// be handled prior to any new instance of the message.
+	if e.repeats > 0 {
+		_ = h.MessageHandler.Handle(e.summary())
+	}
+}
+
+func (h *dedupeMessageHandler) Sync() error {
+	h.l.Lock()
+	defer h.l.Unlock()
+
+	var summaries []FullMessage
+	for key, e := range h.seen {
+		e.timer.Stop()
+		delete(h.seen, key)
+		if e.repeats > 0 {
+			summaries = append(summaries, e.summary())
+		}
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Time.Before(summaries[j].Time)
+	})
+
+	var firstErr error
+	for _, msg := range summaries {
+		if err := h.MessageHandler.Handle(msg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := h.MessageHandler.Sync(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// CaptureMessageHandler is a MessageHandler which stores every message it
+// handles in memory rather than writing them anywhere, so that they can be
+// inspected later. It is primarily useful in tests.
+type CaptureMessageHandler struct {
+	l    sync.Mutex
+	msgs []FullMessage
+}
+
+// NewCaptureMessageHandler initializes and returns a CaptureMessageHandler.
+func NewCaptureMessageHandler() *CaptureMessageHandler {
+	return new(CaptureMessageHandler)
+}
+
+// Handle implements the method for the MessageHandler interface.
+func (h *CaptureMessageHandler) Handle(msg FullMessage) error {
+	h.l.Lock()
+	defer h.l.Unlock()
+	h.msgs = append(h.msgs, msg)
+	return nil
+}
+
+// Sync implements the method for the MessageHandler interface. It is a no-op.
+func (h *CaptureMessageHandler) Sync() error {
+	return nil
+}
+
+// Messages returns all messages which have been handled so far, in the order
+// they were handled.
+func (h *CaptureMessageHandler) Messages() []FullMessage {
+	h.l.Lock()
+	defer h.l.Unlock()
+	msgs := make([]FullMessage, len(h.msgs))
+	copy(msgs, h.msgs)
+	return msgs
+}
+
+type levelRoute struct {
+	level Level
+	h     MessageHandler
+}
+
+type levelRouterMessageHandler struct {
+	routes   []levelRoute // ordered from most to least severe
+	fallback MessageHandler
+}
+
+// NewLevelRouterMessageHandler returns a MessageHandler which passes each
+// message on to one of the given MessageHandlers based on its Level.
+//
+// Each Level in routes acts as a threshold: a message is passed to the
+// MessageHandler of the most severe route Level which the message's Level is at
+// least as severe as, i.e. the closest threshold at or below the message's
+// severity. For example, given routes for LevelWarn and LevelError, LevelWarn
+// messages go to the LevelWarn route, while LevelError and LevelFatal messages
+// go to the LevelError route.
+//
+// If multiple route Levels have the same Int value then the one whose String
+// value sorts first is used, and the others are never used.
+//
+// Messages which don't match any route are passed to fallback, or are
+// discarded if fallback is nil.
+//
+// Calling Sync on the returned MessageHandler calls Sync on all of the given
+// MessageHandlers, even if some return errors, and returns the first error.
+func NewLevelRouterMessageHandler(routes map[Level]MessageHandler, fallback MessageHandler) MessageHandler {
+	h := &levelRouterMessageHandler{fallback: fallback}
+	for lvl, routeH := range routes {
+		h.routes = append(h.routes, levelRoute{level: lvl, h: routeH})
+	}
+	sort.Slice(h.routes, func(i, j int) bool {
+		li, lj := h.routes[i].level, h.routes[j].level
+		if li.Int() != lj.Int() {
+			return li.Int() < lj.Int()
+		}
+		return li.String() < lj.String()
+	})
+	return h
+}
+
+func (h *levelRouterMessageHandler) route(lvl Level) MessageHandler {
+	for _, route := range h.routes {
+		if lvl.Int() <= route.level.Int() {
+			return route.h
+		}
+	}
+	return h.fallback
+}
+
+func (h *levelRouterMessageHandler) Handle(msg FullMessage) error {
+	if routeH := h.route(msg.Level); routeH != nil {
+		return routeH.Handle(msg)
+	}
+	return nil
+}
+
+func (h *levelRouterMessageHandler) Sync() error {
+	var firstErr error
+	for _, route := range h.routes {
+		if err := route.h.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if h.fallback != nil {
+		if err := h.fallback.Sync(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type projectMessageHandler struct {
+	MessageHandler
+	keys map[string]bool
+}
+
+// NewProjectMessageHandler returns a MessageHandler which removes all
+// annotations from each message whose key, when formatted using fmt.Sprint, is
+// not one of the given keys, before passing the message on to the given
+// MessageHandler. All other aspects of the message are left intact.
+func NewProjectMessageHandler(h MessageHandler, keys ...string) MessageHandler {
+	keysM := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		keysM[k] = true
+	}
+	return &projectMessageHandler{MessageHandler: h, keys: keysM}
+}
+
+func (h *projectMessageHandler) Handle(msg FullMessage) error {
+	aa := mctx.EvaluateAnnotations(msg.Context, nil)
+	for k := range aa {
+		if !h.keys[fmt.Sprint(k)] {
+			delete(aa, k)
+		}
+	}
+	msg.Context = mctx.ReplaceAnnotations(msg.Context, aa)
+	return h.MessageHandler.Handle(msg)
+}
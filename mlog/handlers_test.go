@@ -0,0 +1,292 @@
+package mlog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/v2/mtest/massert"
+)
+
+func TestFilterMessageHandler(t *T) {
+	buf := new(bytes.Buffer)
+	h := NewFilterMessageHandler(NewMessageHandler(buf), func(msg FullMessage) bool {
+		aa := mctx.EvaluateAnnotations(msg.Context, nil)
+		return aa["noisy"] == nil
+	})
+	l := NewLogger(&LoggerOpts{MessageHandler: h, MaxLevel: LevelDebug.Int()})
+
+	ctx := context.Background()
+	l.Debug(ctx, "foo")
+	l.Debug(mctx.Annotate(ctx, "noisy", true), "bar")
+	l.Info(ctx, "baz")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	massert.Require(t,
+		massert.Length(lines, 2),
+		massert.Equal(true, strings.Contains(lines[0], `"descr":"foo"`)),
+		massert.Equal(true, strings.Contains(lines[1], `"descr":"baz"`)),
+	)
+}
+
+func TestDedupeMessageHandler(t *T) {
+	buf := new(bytes.Buffer)
+	h := NewDedupeMessageHandler(NewMessageHandler(buf), time.Hour)
+	l := NewLogger(&LoggerOpts{MessageHandler: h})
+
+	ctx := context.Background()
+	l.Info(ctx, "foo")
+	l.Info(ctx, "foo")
+	l.Info(mctx.Annotate(ctx, "a", "b"), "foo")
+	l.Info(ctx, "foo")
+	l.Info(ctx, "bar")
+	massert.Require(t, massert.Nil(l.Sync()))
+
+	var descrs []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var msg messageJSON
+		massert.Require(t, massert.Nil(json.Unmarshal([]byte(line), &msg)))
+		descrs = append(descrs, msg.Description)
+	}
+
+	massert.Require(t, massert.Equal(
+		[]string{"foo", "foo", "bar", "foo (repeated 2 times)"},
+		descrs,
+	))
+}
+
+func TestDedupeMessageHandlerWindow(t *T) {
+	buf := new(bytes.Buffer)
+	h := NewDedupeMessageHandler(NewMessageHandler(buf), 10*time.Millisecond)
+	l := NewLogger(&LoggerOpts{MessageHandler: h})
+
+	ctx := context.Background()
+	l.Info(ctx, "foo")
+	l.Info(ctx, "foo")
+
+	dh := h.(*dedupeMessageHandler)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dh.l.Lock()
+		n := len(dh.seen)
+		dh.l.Unlock()
+		if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("window never closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	l.Info(ctx, "foo")
+	massert.Require(t, massert.Nil(l.Sync()))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	massert.Require(t, massert.Length(lines, 3))
+	massert.Require(t,
+		massert.Equal(true, strings.Contains(lines[1], `"descr":"foo (repeated 1 times)"`)),
+		massert.Equal(true, strings.Contains(lines[2], `"descr":"foo"`)),
+	)
+}
+
+func TestCaptureMessageHandler(t *T) {
+	h := NewCaptureMessageHandler()
+	l := NewLogger(&LoggerOpts{MessageHandler: h})
+
+	ctx := mctx.Annotate(context.Background(), "a", "b")
+	l.Info(ctx, "foo")
+	l.WithNamespace("ns").WarnString(ctx, "bar")
+
+	msgs := h.Messages()
+	massert.Require(t, massert.Length(msgs, 2))
+	massert.Require(t,
+		massert.Equal(LevelInfo, msgs[0].Level),
+		massert.Equal("foo", msgs[0].Description),
+		massert.Equal(LevelWarn, msgs[1].Level),
+		massert.Equal("bar", msgs[1].Description),
+		massert.Equal([]string{"ns"}, msgs[1].Namespace),
+		massert.Equal(
+			mctx.Annotations{"a": "b"},
+			mctx.EvaluateAnnotations(msgs[1].Context, nil),
+		),
+	)
+}
+
+func TestLevelRouterMessageHandler(t *T) {
+	descrs := func(h *CaptureMessageHandler) []string {
+		var out []string
+		for _, msg := range h.Messages() {
+			out = append(out, msg.Description)
+		}
+		return out
+	}
+
+	warnH := NewCaptureMessageHandler()
+	errH := NewCaptureMessageHandler()
+	fallbackH := NewCaptureMessageHandler()
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: NewLevelRouterMessageHandler(map[Level]MessageHandler{
+			LevelWarn:  warnH,
+			LevelError: errH,
+		}, fallbackH),
+		MaxLevel:  LevelDebug.Int(),
+		FatalFunc: func() {},
+	})
+
+	ctx := context.Background()
+	l.Debug(ctx, "debug")
+	l.Info(ctx, "info")
+	l.WarnString(ctx, "warn")
+	l.ErrorString(ctx, "error")
+	l.Fatal(ctx, "fatal")
+
+	massert.Require(t,
+		massert.Equal([]string{"debug", "info"}, descrs(fallbackH)),
+		massert.Equal([]string{"warn"}, descrs(warnH)),
+		massert.Equal([]string{"error", "fatal"}, descrs(errH)),
+	)
+
+	// routes with the same Int value are chosen between by their String value
+	warnAH, warnBH := NewCaptureMessageHandler(), NewCaptureMessageHandler()
+	l = NewLogger(&LoggerOpts{
+		MessageHandler: NewLevelRouterMessageHandler(map[Level]MessageHandler{
+			level{s: "WARN_B", i: LevelWarn.Int()}: warnBH,
+			level{s: "WARN_A", i: LevelWarn.Int()}: warnAH,
+		}, nil),
+	})
+	for i := 0; i < 10; i++ {
+		l.WarnString(ctx, "warn")
+	}
+	massert.Require(t,
+		massert.Length(warnAH.Messages(), 10),
+		massert.Length(warnBH.Messages(), 0),
+	)
+
+	// with no fallback unmatched messages are discarded
+	l = NewLogger(&LoggerOpts{
+		MessageHandler: NewLevelRouterMessageHandler(map[Level]MessageHandler{
+			LevelError: errH,
+		}, nil),
+	})
+	l.Info(ctx, "info")
+	l.ErrorString(ctx, "error2")
+	massert.Require(t,
+		massert.Equal([]string{"error", "fatal", "error2"}, descrs(errH)),
+	)
+}
+
+func TestProjectMessageHandler(t *T) {
+	capture := NewCaptureMessageHandler()
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: NewProjectMessageHandler(capture, "a", "errMsg"),
+	})
+
+	ctx := mctx.Annotate(context.Background(), "a", "foo", "b", "bar")
+	l.Warn(ctx, "baz", errors.New("ERR"))
+
+	msgs := capture.Messages()
+	massert.Require(t, massert.Length(msgs, 1))
+	massert.Require(t,
+		massert.Equal(LevelWarn, msgs[0].Level),
+		massert.Equal("baz", msgs[0].Description),
+		massert.Equal(
+			map[string]string{"a": "foo", "errMsg": "ERR"},
+			mctx.EvaluateAnnotations(msgs[0].Context, nil).StringMap(),
+		),
+	)
+}
+
+// failingCaptureHandler is a CaptureMessageHandler whose Handle and Sync
+// methods return an error while fail is true.
+type failingCaptureHandler struct {
+	*CaptureMessageHandler
+	fail  bool
+	syncs int
+}
+
+var errFailingCapture = errors.New("failing")
+
+func (h *failingCaptureHandler) Handle(msg FullMessage) error {
+	if h.fail {
+		return errFailingCapture
+	}
+	return h.CaptureMessageHandler.Handle(msg)
+}
+
+func (h *failingCaptureHandler) Sync() error {
+	h.syncs++
+	if h.fail {
+		return errFailingCapture
+	}
+	return nil
+}
+
+func TestDedupeMessageHandlerErrors(t *T) {
+	ctx := context.Background()
+	msg := func(descr string) FullMessage {
+		return FullMessage{Message: mkMsg(ctx, LevelInfo, descr)}
+	}
+
+	inner := &failingCaptureHandler{
+		CaptureMessageHandler: NewCaptureMessageHandler(),
+		fail:                  true,
+	}
+	h := NewDedupeMessageHandler(inner, time.Hour)
+
+	// no window is opened if the first instance fails, so the next instance
+	// is attempted too.
+	massert.Require(t,
+		massert.Equal(errFailingCapture, h.Handle(msg("foo"))),
+		massert.Equal(errFailingCapture, h.Handle(msg("foo"))),
+	)
+
+	inner.fail = false
+	massert.Require(t,
+		massert.Nil(h.Handle(msg("foo"))),
+		massert.Nil(h.Handle(msg("foo"))),
+		massert.Nil(h.Handle(msg("bar"))),
+		massert.Nil(h.Handle(msg("bar"))),
+	)
+
+	// all summaries are attempted, and the inner handler is synced, even when
+	// errors are encountered.
+	inner.fail = true
+	massert.Require(t,
+		massert.Equal(errFailingCapture, h.Sync()),
+		massert.Equal(1, inner.syncs),
+		massert.Length(h.(*dedupeMessageHandler).seen, 0),
+	)
+
+	var descrs []string
+	for _, msg := range inner.Messages() {
+		descrs = append(descrs, msg.Description)
+	}
+	massert.Require(t, massert.Equal([]string{"foo", "bar"}, descrs))
+}
+
+func TestLevelRouterMessageHandlerSync(t *T) {
+	newHandler := func(fail bool) *failingCaptureHandler {
+		return &failingCaptureHandler{
+			CaptureMessageHandler: NewCaptureMessageHandler(),
+			fail:                  fail,
+		}
+	}
+
+	warnH, errH, fallbackH := newHandler(false), newHandler(true), newHandler(false)
+	h := NewLevelRouterMessageHandler(map[Level]MessageHandler{
+		LevelWarn:  warnH,
+		LevelError: errH,
+	}, fallbackH)
+
+	massert.Require(t,
+		massert.Equal(errFailingCapture, h.Sync()),
+		massert.Equal(1, warnH.syncs),
+		massert.Equal(1, errH.syncs),
+		massert.Equal(1, fallbackH.syncs),
+	)
+}
@@ -8,14 +8,19 @@
 package mlog
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
@@ -49,7 +54,8 @@ type Level interface {
 
 	// Int gives an integer indicator of the severity of the level, with zero
 	// being most severe. If a Level with a negative Int is logged then the
-	// Logger implementation provided by this package will exit the process.
+	// Logger implementation provided by this package will call its FatalFunc,
+	// which by default exits the process.
 	Int() int
 }
 
@@ -75,24 +81,86 @@ var (
 	LevelFatal Level = level{s: "FATAL", i: -1}
 )
 
-// LevelFromString takes a string describing one of the pre-defined Levels (e.g.
-// "debug" or "INFO") and returns the corresponding Level instance, or nil if
-// the string doesn't describe any of the predefined Levels.
-func LevelFromString(s string) Level {
-	switch strings.TrimSpace(strings.ToUpper(s)) {
-	case "DEBUG":
-		return LevelDebug
-	case "INFO":
-		return LevelInfo
-	case "WARN":
-		return LevelWarn
-	case "ERROR":
-		return LevelError
-	case "FATAL":
-		return LevelFatal
-	default:
-		return nil
+type levelRegistry struct {
+	l      sync.RWMutex
+	byName map[string]Level
+	byInt  map[int]Level
+}
+
+var levels = func() *levelRegistry {
+	r := &levelRegistry{
+		byName: map[string]Level{},
+		byInt:  map[int]Level{},
+	}
+	for _, lvl := range []Level{
+		LevelDebug, LevelInfo, LevelWarn, LevelError, LevelFatal,
+	} {
+		r.byName[lvl.String()] = lvl
+		r.byInt[lvl.Int()] = lvl
+	}
+	return r
+}()
+
+func normalizeLevelName(s string) string {
+	return strings.TrimSpace(strings.ToUpper(s))
+}
+
+// RegisterLevel creates and returns a new Level with the given name and Int
+// value, and records it such that it can be found by LevelFromString and is
+// included in the output of Levels. The name will be upper-cased.
+//
+// Non-positive Int values are reserved, negative ones for fatal Levels and
+// zero for the default value of LoggerOpts.MaxLevel.
+//
+// NOTE This will panic if name is empty or only whitespace, if i is not
+// positive, or if a Level with the same name or Int value has already been
+// registered (including the pre-defined Levels).
+func RegisterLevel(name string, i int) Level {
+	lvl := level{s: normalizeLevelName(name), i: i}
+
+	if lvl.s == "" {
+		panic("Level names passed to mlog.RegisterLevel must not be empty")
+	} else if i <= 0 {
+		panic("Level Int values passed to mlog.RegisterLevel must be positive")
+	}
+
+	levels.l.Lock()
+	defer levels.l.Unlock()
+
+	if _, ok := levels.byName[lvl.s]; ok {
+		panic("mlog.RegisterLevel called with duplicate name " + lvl.s)
+	} else if _, ok := levels.byInt[lvl.i]; ok {
+		panic("mlog.RegisterLevel called with duplicate Int value for " + lvl.s)
+	}
+
+	levels.byName[lvl.s] = lvl
+	levels.byInt[lvl.i] = lvl
+	return lvl
+}
+
+// Levels returns all pre-defined and registered Levels, ordered from most to
+// least severe.
+func Levels() []Level {
+	levels.l.RLock()
+	defer levels.l.RUnlock()
+
+	out := make([]Level, 0, len(levels.byInt))
+	for _, lvl := range levels.byInt {
+		out = append(out, lvl)
 	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Int() < out[j].Int()
+	})
+	return out
+}
+
+// LevelFromString takes a string describing one of the pre-defined or
+// registered Levels (e.g. "debug" or "INFO") and returns the corresponding Level
+// instance, or nil if the string doesn't describe any known Level.
+func LevelFromString(s string) Level {
+	levels.l.RLock()
+	defer levels.l.RUnlock()
+	return levels.byName[normalizeLevelName(s)]
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -110,6 +178,12 @@ type FullMessage struct {
 	Message
 	Time      time.Time
 	Namespace []string
+
+	// Seq is a number which is incremented for every message handled by a
+	// Logger, and which is shared between a Logger and all Loggers derived
+	// from it. A gap in Seq values therefore indicates that messages were
+	// dropped somewhere after being handed to the MessageHandler.
+	Seq uint64
 }
 
 // MessageHandler is a type which can process Messages in some way.
@@ -126,10 +200,14 @@ type MessageHandler interface {
 }
 
 type messageHandler struct {
-	l   sync.Mutex
-	out io.Writer
-	enc *json.Encoder
-	aa  mctx.Annotations
+	l       sync.Mutex
+	out     io.Writer
+	buf     *bytes.Buffer
+	enc     *json.Encoder
+	aa      mctx.Annotations
+	color   bool
+	maxAL   int
+	flatten bool
 }
 
 // NewMessageHandler initializes and returns a MessageHandler which will write
@@ -137,16 +215,114 @@ type messageHandler struct {
 // also implements a Sync or Flush method then that will be called when Sync is
 // called on the returned MessageHandler.
 func NewMessageHandler(out io.Writer) MessageHandler {
-	return &messageHandler{
-		out: out,
-		enc: json.NewEncoder(out),
-		aa:  mctx.Annotations{},
+	return NewMessageHandlerWithOpts(out, nil)
+}
+
+// ColorMode describes when a MessageHandler will colorize the level of each
+// message it writes, using ANSI escape codes.
+type ColorMode int
+
+// All possible ColorMode values.
+const (
+	// ColorNever disables colorized output.
+	ColorNever ColorMode = iota
+
+	// ColorAuto enables colorized output only if the io.Writer being written
+	// to is a terminal.
+	ColorAuto
+
+	// ColorAlways enables colorized output regardless of what the io.Writer
+	// being written to is.
+	ColorAlways
+)
+
+// MessageHandlerOpts are optional parameters to NewMessageHandlerWithOpts. All
+// fields are optional. A nil value of MessageHandlerOpts is equivalent to an
+// empty one.
+type MessageHandlerOpts struct {
+	// Color indicates whether or not the level of each message should be
+	// colorized based on its severity. Colorized output is not valid JSON.
+	//
+	// Defaults to ColorNever.
+	Color ColorMode
+
+	// MaxAnnotationLength, if greater than zero, causes all annotation values
+	// longer than it to be shortened using Truncate prior to being written.
+	// This only affects the written output, not the annotations themselves.
+	//
+	// Defaults to 0, meaning no truncation.
+	MaxAnnotationLength int
+
+	// FlattenAnnotations, if true, causes annotations to be passed through
+	// FlattenAnnotations prior to being written.
+	FlattenAnnotations bool
+}
+
+// NewMessageHandlerWithOpts is like NewMessageHandler, but allows for passing
+// in optional parameters which affect the output.
+func NewMessageHandlerWithOpts(out io.Writer, opts *MessageHandlerOpts) MessageHandler {
+	if opts == nil {
+		opts = new(MessageHandlerOpts)
+	}
+
+	h := &messageHandler{
+		out:     out,
+		buf:     new(bytes.Buffer),
+		aa:      mctx.Annotations{},
+		maxAL:   opts.MaxAnnotationLength,
+		flatten: opts.FlattenAnnotations,
+	}
+
+	switch opts.Color {
+	case ColorAuto:
+		h.color = isTerminal(out)
+	case ColorAlways:
+		h.color = true
+	}
+
+	h.enc = json.NewEncoder(h.buf)
+	return h
+}
+
+// isTerminal returns true if the given io.Writer is a file which is a
+// character device, i.e. a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorGreen  = "\x1b[32m"
+	colorGray   = "\x1b[90m"
+)
+
+func levelColor(lvl Level) string {
+	switch i := lvl.Int(); {
+	case i <= LevelError.Int():
+		return colorRed
+	case i <= LevelWarn.Int():
+		return colorYellow
+	case i <= LevelInfo.Int():
+		return colorGreen
+	default:
+		return colorGray
 	}
 }
 
 type messageJSON struct {
 	TimeDate    string   `json:"td"`
 	Timestamp   int64    `json:"ts"`
+	Seq         uint64   `json:"seq"`
 	Level       string   `json:"level"`
 	Namespace   []string `json:"ns,omitempty"`
 	Description string   `json:"descr"`
@@ -162,29 +338,63 @@ func (h *messageHandler) Handle(msg FullMessage) error {
 	h.l.Lock()
 	defer h.l.Unlock()
 
+	aa := mctx.EvaluateAnnotations(msg.Context, h.aa)
+	if h.flatten {
+		aa = FlattenAnnotations(aa)
+	}
+
 	msgJSON := messageJSON{
 		TimeDate:    msg.Time.UTC().Format(msgTimeFormat),
 		Timestamp:   msg.Time.UnixNano(),
+		Seq:         msg.Seq,
 		Level:       msg.Level.String(),
 		LevelInt:    msg.Level.Int(),
 		Namespace:   msg.Namespace,
 		Description: msg.Description,
-		Annotations: mctx.EvaluateAnnotations(msg.Context, h.aa).StringMap(),
+		Annotations: aa.StringMap(),
 	}
 
 	for k := range h.aa {
 		delete(h.aa, k)
 	}
 
-	return h.enc.Encode(msgJSON)
+	if h.maxAL > 0 {
+		for k, v := range msgJSON.Annotations {
+			msgJSON.Annotations[k] = Truncate(v, h.maxAL)
+		}
+	}
+
+	h.buf.Reset()
+	if err := h.enc.Encode(msgJSON); err != nil {
+		return err
+	}
+
+	b := h.buf.Bytes()
+	if h.color {
+		levelJSON, err := json.Marshal(msgJSON.Level)
+		if err != nil {
+			return err
+		}
+		levelField := `"level":` + string(levelJSON)
+		colorized := `"level":` + levelColor(msg.Level) + string(levelJSON) + colorReset
+		b = bytes.Replace(b, []byte(levelField), []byte(colorized), 1)
+	}
+
+	_, err := h.out.Write(b)
+	return err
 }
 
 func (h *messageHandler) Sync() error {
 	h.l.Lock()
 	defer h.l.Unlock()
-	if s, ok := h.out.(interface{ Sync() error }); ok {
+	return syncWriter(h.out)
+}
+
+// syncWriter calls the Sync or Flush method on the io.Writer, if it has one.
+func syncWriter(out io.Writer) error {
+	if s, ok := out.(interface{ Sync() error }); ok {
 		return s.Sync()
-	} else if f, ok := h.out.(interface{ Flush() error }); ok {
+	} else if f, ok := out.(interface{ Flush() error }); ok {
 		return f.Flush()
 	}
 	return nil
@@ -209,6 +419,45 @@ type LoggerOpts struct {
 	//
 	// Defaults to time.Now.
 	Now func() time.Time
+
+	// SkipDebugWhenDone, if true, causes messages which are no more severe than
+	// LevelDebug to be discarded if their Context has already been canceled or
+	// has passed its deadline.
+	SkipDebugWhenDone bool
+
+	// AnnotateDeadline, if true, causes messages whose Context has a deadline
+	// to have it included under the "ctxDeadline" annotation, and messages
+	// whose Context has been canceled or has passed its deadline to have the
+	// Context's error included under the "ctxErr" annotation.
+	AnnotateDeadline bool
+
+	// StacktraceLevel, if set, causes all messages which are at least as severe
+	// as it to have the full stacktrace of where they were logged from included
+	// under the "stack" annotation. Stack frames belonging to Logger itself are
+	// omitted.
+	//
+	// Defaults to nil, meaning no stacktraces are included.
+	StacktraceLevel Level
+
+	// FatalFunc is called after a message with a fatal Level (see the Level
+	// interface) has been handled and the MessageHandler has been synced.
+	//
+	// Defaults to calling os.Exit(1).
+	FatalFunc func()
+
+	// ErrorHandler is called synchronously whenever the MessageHandler returns
+	// an error from its Handle method, and is given the FullMessage which
+	// failed to be handled along with the error.
+	//
+	// Defaults to writing a single line describing the error to os.Stderr.
+	ErrorHandler func(FullMessage, error)
+}
+
+func defaultErrorHandler(msg FullMessage, err error) {
+	fmt.Fprintf(os.Stderr,
+		"mlog: MessageHandler.Handle returned error for message %q: %v\n",
+		msg.Description, err,
+	)
 }
 
 func (o *LoggerOpts) withDefaults() *LoggerOpts {
@@ -229,38 +478,83 @@ func (o *LoggerOpts) withDefaults() *LoggerOpts {
 		out.Now = time.Now
 	}
 
+	if out.FatalFunc == nil {
+		out.FatalFunc = func() { os.Exit(1) }
+	}
+
+	if out.ErrorHandler == nil {
+		out.ErrorHandler = defaultErrorHandler
+	}
+
 	return out
 }
 
 // Logger creates and directs Messages to an internal MessageHandler. All
 // methods are thread-safe.
 type Logger struct {
-	opts *LoggerOpts
-	l    *sync.RWMutex
-	ns   []string
+	opts   *LoggerOpts
+	l      *sync.RWMutex
+	ns     []string
+	counts *levelCounts
+	seq    *uint64
+	hooks  []func(Message) Message
+}
+
+type levelCounts struct {
+	l sync.Mutex
+	m map[int]uint64
 }
 
 // NewLogger initializes and returns a new instance of Logger.
 func NewLogger(opts *LoggerOpts) *Logger {
 	return &Logger{
-		opts: opts.withDefaults(),
-		l:    new(sync.RWMutex),
+		opts:   opts.withDefaults(),
+		l:      new(sync.RWMutex),
+		counts: &levelCounts{m: map[int]uint64{}},
+		seq:    new(uint64),
 	}
 }
 
+// Sync flushes any data buffered by the Logger's MessageHandler, without
+// otherwise affecting the Logger.
+func (l *Logger) Sync() error {
+	return l.opts.MessageHandler.Sync()
+}
+
 // Close cleans up all resources held by the Logger.
 func (l *Logger) Close() error {
-	if err := l.opts.MessageHandler.Sync(); err != nil {
+	if err := l.Sync(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Counts returns the number of messages which have been handled by the Logger
+// so far, keyed by the Int value of each message's Level. A message is counted
+// if it passes the Logger's MaxLevel check and the MessageHandler's Handle
+// method returns nil for it, regardless of whether the MessageHandler actually
+// wrote the message anywhere. For example, a message discarded by a
+// MessageHandler returned from NewFilterMessageHandler is still counted.
+//
+// Counts are shared between a Logger and all Loggers derived from it, e.g. via
+// WithNamespace.
+func (l *Logger) Counts() map[int]uint64 {
+	l.counts.l.Lock()
+	defer l.counts.l.Unlock()
+	m := make(map[int]uint64, len(l.counts.m))
+	for i, c := range l.counts.m {
+		m[i] = c
+	}
+	return m
+}
+
 func (l *Logger) clone() *Logger {
 	l2 := *l
 	l2.l = new(sync.RWMutex)
 	l2.ns = make([]string, len(l.ns), len(l.ns)+1)
 	copy(l2.ns, l.ns)
+	l2.hooks = make([]func(Message) Message, len(l.hooks), len(l.hooks)+1)
+	copy(l2.hooks, l.hooks)
 	return &l2
 }
 
@@ -273,10 +567,28 @@ func (l *Logger) WithNamespace(name string) *Logger {
 	return l
 }
 
+// WithMessageHook returns a clone of the Logger with the given hook added to
+// it. Each Message which passes the Logger's MaxLevel check is passed through
+// all of the Logger's hooks, in the order they were added, and the Message
+// returned from the final hook is the one which is handled. Hooks can
+// therefore be used to modify the Description, annotations, etc... of every
+// Message in one place.
+//
+// If a hook returns a Message with a nil Level or Context then the Level or
+// Context of the Message passed into that hook is retained. A hook which changes the Level to a fatal
+// one will cause the Logger's FatalFunc to be called.
+func (l *Logger) WithMessageHook(hook func(Message) Message) *Logger {
+	l = l.clone()
+	l.hooks = append(l.hooks, hook)
+	return l
+}
+
 // Log can be used to manually log a message of some custom defined Level.
 //
-// If the Level is a fatal (Uint() == 0) then calling this will never return,
-// and the process will have os.Exit(1) called.
+// If the Level is fatal (Int() < 0) then, once the message has been handled and
+// the MessageHandler synced, the Logger's FatalFunc is called. By default this
+// means calling this will never return, and the process will have os.Exit(1)
+// called.
 func (l *Logger) Log(msg Message) {
 	l.l.RLock()
 	defer l.l.RUnlock()
@@ -285,23 +597,110 @@ func (l *Logger) Log(msg Message) {
 		return
 	}
 
+	if l.opts.SkipDebugWhenDone &&
+		msg.Level.Int() >= LevelDebug.Int() &&
+		msg.Context.Err() != nil {
+		return
+	}
+
+	if l.opts.AnnotateDeadline {
+		if deadline, ok := msg.Context.Deadline(); ok {
+			msg.Context = mctx.Annotate(msg.Context,
+				mlogAnnotation("ctxDeadline"), deadline.Format(time.RFC3339Nano),
+			)
+		}
+		if err := msg.Context.Err(); err != nil {
+			msg.Context = mctx.Annotate(msg.Context,
+				mlogAnnotation("ctxErr"), err.Error(),
+			)
+		}
+	}
+
+	if lvl := l.opts.StacktraceLevel; lvl != nil && msg.Level.Int() <= lvl.Int() {
+		stack := merr.NewStacktrace(loggerFrames())
+		msg.Context = mctx.Annotate(msg.Context,
+			mlogAnnotation("stack"), stack.FullString(),
+		)
+	}
+
+	for _, hook := range l.hooks {
+		lvl, ctx := msg.Level, msg.Context
+		msg = hook(msg)
+		if msg.Level == nil {
+			msg.Level = lvl
+		}
+		if msg.Context == nil {
+			msg.Context = ctx
+		}
+	}
+
 	fullMsg := FullMessage{
 		Message:   msg,
 		Time:      l.opts.Now(),
 		Namespace: l.ns,
+		Seq:       atomic.AddUint64(l.seq, 1),
 	}
 
 	if err := l.opts.MessageHandler.Handle(fullMsg); err != nil {
-		go l.Error(context.Background(), "MessageHandler.Handle returned error", err)
-		return
+		l.opts.ErrorHandler(fullMsg, err)
+	} else {
+		l.counts.l.Lock()
+		l.counts.m[msg.Level.Int()]++
+		l.counts.l.Unlock()
 	}
 
 	if msg.Level.Int() < 0 {
-		l.opts.MessageHandler.Sync()
-		os.Exit(1)
+		l.Sync()
+		l.opts.FatalFunc()
 	}
 }
 
+const loggerFuncPrefix = "github.com/mediocregopher/mediocre-go-lib/v2/mlog.(*Logger)."
+
+// loggerFrames returns the number of consecutive stack frames, starting with
+// the caller of loggerFrames, which belong to methods of Logger.
+func loggerFrames() int {
+	pcs := make([]uintptr, 8)
+	n := runtime.Callers(2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var count int
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, loggerFuncPrefix) {
+			break
+		}
+		count++
+		if !more {
+			break
+		}
+	}
+	return count
+}
+
+type ctxKeyLogger int
+
+// defaultLogger is returned by FromContext when no Logger has been set on the
+// Context. It is only initialized once so that FromContext doesn't allocate.
+var defaultLogger = NewLogger(nil)
+
+// WithLogger returns a copy of the Context with the given Logger set on it,
+// such that it can be retrieved using FromContext.
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKeyLogger(0), l)
+}
+
+// FromContext returns the Logger which was set on the Context using
+// WithLogger. If no Logger has been set then a default Logger, equivalent to
+// NewLogger(nil), is returned. The same default Logger instance is returned on
+// every call.
+func FromContext(ctx context.Context) *Logger {
+	if l, _ := ctx.Value(ctxKeyLogger(0)).(*Logger); l != nil {
+		return l
+	}
+	return defaultLogger
+}
+
 func mkMsg(ctx context.Context, lvl Level, descr string) Message {
 	return Message{
 		Context:     ctx,
@@ -310,19 +709,27 @@ func mkMsg(ctx context.Context, lvl Level, descr string) Message {
 	}
 }
 
-func mkErrMsg(ctx context.Context, lvl Level, descr string, err error) Message {
+// errAnnotator annotates with information about an error. It is used so that
+// the error is only formatted if the message it's attached to is actually
+// handled.
+type errAnnotator struct {
+	err error
+}
+
+func (ea errAnnotator) Annotate(aa mctx.Annotations) {
+	aa[mlogAnnotation("errMsg")] = ea.err.Error()
+
 	var e merr.Error
-	if !errors.As(err, &e) {
-		ctx = mctx.Annotate(ctx, mlogAnnotation("errMsg"), err.Error())
-		return mkMsg(ctx, lvl, descr)
+	if !errors.As(ea.err, &e) {
+		return
 	}
 
-	ctx = mctx.Annotate(ctx,
-		mlogAnnotation("errMsg"), err.Error(),
-		mlogAnnotation("errCtx"), mctx.ContextAsAnnotator(e.Ctx),
-		mlogAnnotation("errLine"), e.Stacktrace.String(),
-	)
+	aa[mlogAnnotation("errCtx")] = mctx.ContextAsAnnotator(e.Ctx)
+	aa[mlogAnnotation("errLine")] = e.Stacktrace.String()
+}
 
+func mkErrMsg(ctx context.Context, lvl Level, descr string, err error) Message {
+	ctx = mctx.WithAnnotator(ctx, errAnnotator{err: err})
 	return mkMsg(ctx, lvl, descr)
 }
 
@@ -357,7 +764,7 @@ func (l *Logger) Error(ctx context.Context, descr string, err error) {
 }
 
 // Fatal logs a LevelFatal message. A Fatal message automatically stops the
-// process with an os.Exit(1) if the default MessageHandler is used.
+// process with an os.Exit(1) if the default FatalFunc is used.
 func (l *Logger) Fatal(ctx context.Context, descr string) {
 	l.Log(mkMsg(ctx, LevelFatal, descr))
 }
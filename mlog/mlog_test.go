@@ -3,6 +3,7 @@ package mlog
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -49,22 +50,440 @@ func TestLogger(t *T) {
 	l.Warn(ctx, "baz", errors.New("ERR"))
 	l.Error(ctx, "buz", errors.New("ERR"))
 	massert.Require(t,
-		assertOut(`{"td":"<TD>","ts":<TS>,"level":"INFO","descr":"bar","level_int":30}`),
-		assertOut(`{"td":"<TD>","ts":<TS>,"level":"WARN","descr":"baz","level_int":20,"annotations":{"errMsg":"ERR"}}`),
-		assertOut(`{"td":"<TD>","ts":<TS>,"level":"ERROR","descr":"buz","level_int":10,"annotations":{"errMsg":"ERR"}}`),
+		assertOut(`{"td":"<TD>","ts":<TS>,"seq":1,"level":"INFO","descr":"bar","level_int":30}`),
+		assertOut(`{"td":"<TD>","ts":<TS>,"seq":2,"level":"WARN","descr":"baz","level_int":20,"annotations":{"errMsg":"ERR"}}`),
+		assertOut(`{"td":"<TD>","ts":<TS>,"seq":3,"level":"ERROR","descr":"buz","level_int":10,"annotations":{"errMsg":"ERR"}}`),
 	)
 
 	// annotate context
 	ctx = mctx.Annotate(ctx, "foo", "bar")
 	l.Info(ctx, "bar")
 	massert.Require(t,
-		assertOut(`{"td":"<TD>","ts":<TS>,"level":"INFO","descr":"bar","level_int":30,"annotations":{"foo":"bar"}}`),
+		assertOut(`{"td":"<TD>","ts":<TS>,"seq":4,"level":"INFO","descr":"bar","level_int":30,"annotations":{"foo":"bar"}}`),
 	)
 
 	// add namespace
 	l = l.WithNamespace("ns")
 	l.Info(ctx, "bar")
 	massert.Require(t,
-		assertOut(`{"td":"<TD>","ts":<TS>,"level":"INFO","ns":["ns"],"descr":"bar","level_int":30,"annotations":{"foo":"bar"}}`),
+		assertOut(`{"td":"<TD>","ts":<TS>,"seq":5,"level":"INFO","ns":["ns"],"descr":"bar","level_int":30,"annotations":{"foo":"bar"}}`),
+	)
+}
+
+func TestMessageHandlerColor(t *T) {
+	now := time.Now().UTC()
+	td, ts := now.Format(msgTimeFormat), fmt.Sprint(now.UnixNano())
+	msg := FullMessage{
+		Message: mkMsg(context.Background(), LevelError, "foo"),
+		Time:    now,
+		Seq:     1,
+	}
+
+	handle := func(color ColorMode) string {
+		buf := new(bytes.Buffer)
+		h := NewMessageHandlerWithOpts(buf, &MessageHandlerOpts{Color: color})
+		massert.Require(t, massert.Nil(h.Handle(msg)))
+		return strings.TrimSpace(buf.String())
+	}
+
+	exp := `{"td":"<TD>","ts":<TS>,"seq":1,"level":"ERROR","descr":"foo","level_int":10}`
+	exp = strings.ReplaceAll(exp, "<TD>", td)
+	exp = strings.ReplaceAll(exp, "<TS>", ts)
+	expColor := strings.ReplaceAll(exp, `"ERROR"`, "\x1b[31m\"ERROR\"\x1b[0m")
+
+	massert.Require(t,
+		massert.Equal(exp, handle(ColorNever)),
+		massert.Equal(exp, handle(ColorAuto)),
+		massert.Equal(expColor, handle(ColorAlways)),
+	)
+}
+
+func TestLoggerAnnotationPrecedence(t *T) {
+	buf := new(bytes.Buffer)
+	l := NewLogger(&LoggerOpts{MessageHandler: NewMessageHandler(buf)})
+
+	parent := mctx.Annotate(context.Background(), "user", "alice", "reqID", "1")
+	child := mctx.Annotate(parent, "user", "bob")
+
+	l.Info(parent, "parent")
+	l.Info(child, "child")
+
+	var msgs []messageJSON
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var msg messageJSON
+		massert.Require(t, massert.Nil(dec.Decode(&msg)))
+		msgs = append(msgs, msg)
+	}
+
+	massert.Require(t,
+		massert.Length(msgs, 2),
+		massert.Equal(map[string]string{"user": "alice", "reqID": "1"}, msgs[0].Annotations),
+		massert.Equal(map[string]string{"user": "bob", "reqID": "1"}, msgs[1].Annotations),
+	)
+}
+
+func TestLoggerCounts(t *T) {
+	l := NewLogger(&LoggerOpts{MessageHandler: NewMessageHandler(new(bytes.Buffer))})
+	ctx := context.Background()
+
+	l.Debug(ctx, "foo") // filtered out by MaxLevel, so not counted
+	l.Info(ctx, "foo")
+	l.Info(ctx, "bar")
+
+	l2 := l.WithNamespace("ns")
+	l2.WarnString(ctx, "baz")
+	l2.Error(ctx, "buz", errors.New("ERR"))
+
+	exp := map[int]uint64{
+		LevelInfo.Int():  2,
+		LevelWarn.Int():  1,
+		LevelError.Int(): 1,
+	}
+	massert.Require(t,
+		massert.Equal(exp, l.Counts()),
+		massert.Equal(exp, l2.Counts()),
+	)
+}
+
+func TestLoggerContext(t *T) {
+	ctx := context.Background()
+	l := NewLogger(nil)
+
+	massert.Require(t,
+		massert.Equal(true, FromContext(ctx) == defaultLogger),
+		massert.Equal(true, FromContext(ctx) == FromContext(ctx)),
+		massert.Equal(true, FromContext(WithLogger(ctx, l)) == l),
+	)
+}
+
+type syncCountHandler struct {
+	MessageHandler
+	syncs int
+}
+
+func (h *syncCountHandler) Sync() error {
+	h.syncs++
+	return h.MessageHandler.Sync()
+}
+
+func TestLoggerSync(t *T) {
+	h := &syncCountHandler{MessageHandler: NewMessageHandler(new(bytes.Buffer))}
+	l := NewLogger(&LoggerOpts{MessageHandler: h})
+
+	massert.Require(t, massert.Nil(l.Sync()))
+	massert.Require(t, massert.Nil(l.Close()))
+	massert.Require(t, massert.Equal(2, h.syncs))
+}
+
+func TestRegisterLevel(t *T) {
+	// restore the registry afterwards, so the test can be run repeatedly
+	origByName, origByInt := map[string]Level{}, map[int]Level{}
+	for k, v := range levels.byName {
+		origByName[k] = v
+	}
+	for k, v := range levels.byInt {
+		origByInt[k] = v
+	}
+	defer func() {
+		levels.byName, levels.byInt = origByName, origByInt
+	}()
+
+	trace := RegisterLevel("trace", 50)
+	notice := RegisterLevel("Notice", 25)
+
+	massert.Require(t,
+		massert.Equal("TRACE", trace.String()),
+		massert.Equal(50, trace.Int()),
+		massert.Equal(trace, LevelFromString("TRACE")),
+		massert.Equal(notice, LevelFromString(" notice")),
+		massert.Equal(LevelInfo, LevelFromString("info")),
+		massert.Nil(LevelFromString("bogus")),
+		massert.Equal([]Level{
+			LevelFatal, LevelError, LevelWarn, notice, LevelInfo, LevelDebug, trace,
+		}, Levels()),
+	)
+
+	assertPanics := func(name string, i int) massert.Assertion {
+		var panicked bool
+		func() {
+			defer func() { panicked = recover() != nil }()
+			RegisterLevel(name, i)
+		}()
+		return massert.Comment(massert.Equal(true, panicked), "name:%q i:%d", name, i)
+	}
+
+	massert.Require(t,
+		assertPanics("", 45),
+		assertPanics(" \t", 45),
+		assertPanics("foo", 0),
+		assertPanics("foo", -2),
+		assertPanics("debug", 45),
+		assertPanics("foo", LevelWarn.Int()),
+	)
+}
+
+type errHandler struct{ err error }
+
+func (h errHandler) Handle(FullMessage) error { return h.err }
+
+func (h errHandler) Sync() error { return nil }
+
+func TestLoggerErrorHandler(t *T) {
+	handleErr := errors.New("ERR")
+
+	var gotMsgs []FullMessage
+	var gotErrs []error
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: errHandler{err: handleErr},
+		ErrorHandler: func(msg FullMessage, err error) {
+			gotMsgs = append(gotMsgs, msg)
+			gotErrs = append(gotErrs, err)
+		},
+	})
+
+	l.Info(context.Background(), "foo")
+	massert.Require(t,
+		massert.Length(gotMsgs, 1),
+		massert.Equal("foo", gotMsgs[0].Description),
+		massert.Equal([]error{handleErr}, gotErrs),
+		massert.Length(l.Counts(), 0),
+	)
+}
+
+type countingErr struct{ calls *int }
+
+func (e countingErr) Error() string {
+	*e.calls++
+	return "ERR"
+}
+
+type countingAnnotator struct{ calls *int }
+
+func (a countingAnnotator) Annotate(aa mctx.Annotations) {
+	*a.calls++
+	aa["foo"] = "bar"
+}
+
+func TestLoggerLazyAnnotations(t *T) {
+	var errCalls, annotatorCalls int
+	err := countingErr{calls: &errCalls}
+	ctx := mctx.WithAnnotator(context.Background(), countingAnnotator{calls: &annotatorCalls})
+
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: NewMessageHandler(new(bytes.Buffer)),
+		MaxLevel:       LevelError.Int(),
+	})
+
+	l.Debug(ctx, "foo")
+	l.Warn(ctx, "foo", err)
+	massert.Require(t,
+		massert.Equal(0, errCalls),
+		massert.Equal(0, annotatorCalls),
+	)
+
+	l.Error(ctx, "foo", err)
+	massert.Require(t,
+		massert.Equal(1, errCalls),
+		massert.Equal(1, annotatorCalls),
+	)
+}
+
+func BenchmarkLoggerFiltered(b *B) {
+	var calls int
+	err := countingErr{calls: &calls}
+	ctx := mctx.WithAnnotator(context.Background(), countingAnnotator{calls: &calls})
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: NewMessageHandler(new(bytes.Buffer)),
+		MaxLevel:       LevelError.Int(),
+	})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Debug(ctx, "foo")
+		l.Warn(ctx, "foo", err)
+	}
+	b.StopTimer()
+
+	if calls > 0 {
+		b.Fatalf("annotations evaluated %d times for filtered messages", calls)
+	}
+}
+
+func TestLoggerStacktrace(t *T) {
+	h := NewCaptureMessageHandler()
+	l := NewLogger(&LoggerOpts{
+		MessageHandler:  h,
+		StacktraceLevel: LevelWarn,
+	})
+
+	ctx := context.Background()
+	l.Info(ctx, "foo")
+	l.WarnString(ctx, "bar")
+	l.Error(ctx, "baz", errors.New("ERR"))
+
+	msgs := h.Messages()
+	massert.Require(t, massert.Length(msgs, 3))
+
+	stackOf := func(msg FullMessage) (string, bool) {
+		stack, ok := mctx.EvaluateAnnotations(msg.Context, nil)[mlogAnnotation("stack")]
+		str, _ := stack.(string)
+		return str, ok
+	}
+
+	_, ok := stackOf(msgs[0])
+	massert.Require(t, massert.Equal(false, ok))
+
+	for _, msg := range msgs[1:] {
+		stack, ok := stackOf(msg)
+		firstLine := strings.SplitN(stack, "\n", 2)[0]
+		massert.Require(t,
+			massert.Equal(true, ok),
+			massert.Comment(
+				massert.Equal(true, strings.Contains(firstLine, "mlog_test.go")),
+				"stack:\n%s", stack,
+			),
+			massert.Comment(
+				massert.Equal(true, strings.HasSuffix(firstLine, "TestLoggerStacktrace")),
+				"stack:\n%s", stack,
+			),
+		)
+	}
+}
+
+func TestMessageHandlerMaxAnnotationLength(t *T) {
+	long := strings.Repeat("a", 10*1024)
+	ctx := mctx.Annotate(context.Background(), "long", long, "short", "b")
+
+	buf := new(bytes.Buffer)
+	h := NewMessageHandlerWithOpts(buf, &MessageHandlerOpts{MaxAnnotationLength: 100})
+	l := NewLogger(&LoggerOpts{MessageHandler: h})
+	l.Info(ctx, "foo")
+
+	var msg messageJSON
+	massert.Require(t, massert.Nil(json.Unmarshal(buf.Bytes(), &msg)))
+	massert.Require(t,
+		massert.Equal(map[string]string{
+			"long":  long[:100] + "...",
+			"short": "b",
+		}, msg.Annotations),
+		massert.Equal(long, mctx.EvaluateAnnotations(ctx, nil)["long"]),
+	)
+}
+
+func TestLoggerFatal(t *T) {
+	capture := NewCaptureMessageHandler()
+	h := &syncCountHandler{MessageHandler: capture}
+
+	var fatalMsgs, fatalSyncs int
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: h,
+		FatalFunc: func() {
+			fatalMsgs = len(capture.Messages())
+			fatalSyncs = h.syncs
+		},
+	})
+
+	l.Fatal(context.Background(), "foo")
+	massert.Require(t,
+		massert.Equal(1, fatalMsgs),
+		massert.Equal(1, fatalSyncs),
+	)
+}
+
+func TestLoggerContextDone(t *T) {
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+
+	capture := NewCaptureMessageHandler()
+	l := NewLogger(&LoggerOpts{
+		MessageHandler:    capture,
+		MaxLevel:          LevelDebug.Int(),
+		SkipDebugWhenDone: true,
+		AnnotateDeadline:  true,
+	})
+
+	l.Debug(ctx, "foo")
+	cancel()
+	l.Debug(ctx, "bar")
+	l.Info(ctx, "baz")
+
+	msgs := capture.Messages()
+	massert.Require(t, massert.Length(msgs, 2))
+
+	deadlineStr := deadline.Format(time.RFC3339Nano)
+	massert.Require(t,
+		massert.Equal("foo", msgs[0].Description),
+		massert.Equal(
+			map[string]string{"ctxDeadline": deadlineStr},
+			mctx.EvaluateAnnotations(msgs[0].Context, nil).StringMap(),
+		),
+		massert.Equal("baz", msgs[1].Description),
+		massert.Equal(
+			map[string]string{
+				"ctxDeadline": deadlineStr,
+				"ctxErr":      context.Canceled.Error(),
+			},
+			mctx.EvaluateAnnotations(msgs[1].Context, nil).StringMap(),
+		),
+	)
+}
+
+func TestLoggerMessageHook(t *T) {
+	capture := NewCaptureMessageHandler()
+	var fatals int
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: capture,
+		FatalFunc:      func() { fatals++ },
+	})
+
+	l2 := l.WithMessageHook(func(msg Message) Message {
+		msg.Description = strings.ReplaceAll(msg.Description, "secret", "***")
+		return msg
+	}).WithMessageHook(func(msg Message) Message {
+		msg.Description += "!"
+		msg.Context = mctx.Annotate(msg.Context, "tenant", "foo")
+		msg.Level = nil
+		return msg
+	})
+
+	ctx := context.Background()
+	l.Info(ctx, "secret")
+	l2.WarnString(ctx, "secret")
+
+	msgs := capture.Messages()
+	massert.Require(t, massert.Length(msgs, 2))
+	massert.Require(t,
+		massert.Equal("secret", msgs[0].Description),
+		massert.Equal(LevelInfo, msgs[0].Level),
+		massert.Equal("***!", msgs[1].Description),
+		massert.Equal(LevelWarn, msgs[1].Level),
+		massert.Equal(
+			mctx.Annotations{"tenant": "foo"},
+			mctx.EvaluateAnnotations(msgs[1].Context, nil),
+		),
+		massert.Equal(0, fatals),
+	)
+}
+
+func TestLoggerMessageHookNilContext(t *T) {
+	capture := NewCaptureMessageHandler()
+	l := NewLogger(&LoggerOpts{MessageHandler: capture}).
+		WithMessageHook(func(msg Message) Message {
+			return Message{Description: msg.Description + "!"}
+		})
+
+	ctx := mctx.Annotate(context.Background(), "a", "b")
+	l.Info(ctx, "foo")
+
+	msgs := capture.Messages()
+	massert.Require(t, massert.Length(msgs, 1))
+	massert.Require(t,
+		massert.Equal("foo!", msgs[0].Description),
+		massert.Equal(LevelInfo, msgs[0].Level),
+		massert.Equal(
+			mctx.Annotations{"a": "b"},
+			mctx.EvaluateAnnotations(msgs[0].Context, nil),
+		),
 	)
 }
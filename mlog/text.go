@@ -0,0 +1,115 @@
+package mlog
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
+)
+
+// TextFormat describes how a message is laid out as a single line of text. The
+// fields of the line are, in order: the time, the level, the namespace (if
+// any), the description, and then each annotation sorted by key.
+type TextFormat struct {
+	// FieldSep is written between each field of the line.
+	//
+	// Defaults to "\t".
+	FieldSep string
+
+	// NamespaceSep is written between each element of the namespace.
+	//
+	// Defaults to "/".
+	NamespaceSep string
+
+	// KVSep is written between the key and value of each annotation.
+	//
+	// Defaults to "=".
+	KVSep string
+}
+
+func (f TextFormat) withDefaults() TextFormat {
+	if f.FieldSep == "" {
+		f.FieldSep = "\t"
+	}
+	if f.NamespaceSep == "" {
+		f.NamespaceSep = "/"
+	}
+	if f.KVSep == "" {
+		f.KVSep = "="
+	}
+	return f
+}
+
+// Format writes the given message to the io.Writer as a single line of text,
+// including the trailing newline. Any namespace, description, key, or value
+// which contains a newline or FieldSep, or which starts with a double quote,
+// will be quoted using strconv.Quote. Keys which contain KVSep are quoted as
+// well, so that the first unquoted KVSep always separates a key from its value.
+func (f TextFormat) Format(w io.Writer, msg FullMessage) error {
+	f = f.withDefaults()
+	quote := func(s string) string {
+		if strings.Contains(s, "\n") ||
+			strings.Contains(s, f.FieldSep) ||
+			strings.HasPrefix(s, `"`) {
+			return strconv.Quote(s)
+		}
+		return s
+	}
+	quoteKey := func(s string) string {
+		if strings.Contains(s, f.KVSep) {
+			return strconv.Quote(s)
+		}
+		return quote(s)
+	}
+
+	sb := new(strings.Builder)
+	sb.WriteString(msg.Time.UTC().Format(msgTimeFormat))
+	sb.WriteString(f.FieldSep)
+	sb.WriteString(msg.Level.String())
+	if len(msg.Namespace) > 0 {
+		sb.WriteString(f.FieldSep)
+		sb.WriteString(quote(strings.Join(msg.Namespace, f.NamespaceSep)))
+	}
+	sb.WriteString(f.FieldSep)
+	sb.WriteString(quote(msg.Description))
+
+	for _, kv := range mctx.EvaluateAnnotations(msg.Context, nil).StringSlice(true) {
+		sb.WriteString(f.FieldSep)
+		sb.WriteString(quoteKey(kv[0]))
+		sb.WriteString(f.KVSep)
+		sb.WriteString(quote(kv[1]))
+	}
+	sb.WriteString("\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+type textMessageHandler struct {
+	l      sync.Mutex
+	out    io.Writer
+	format TextFormat
+}
+
+// NewTextMessageHandler initializes and returns a MessageHandler which will
+// write all messages to the given io.Writer as lines of text, laid out
+// according to the given TextFormat, in a thread-safe way. Like
+// NewMessageHandler, if the io.Writer also implements a Sync or Flush method
+// then that will be called when Sync is called on the returned MessageHandler.
+func NewTextMessageHandler(out io.Writer, format TextFormat) MessageHandler {
+	return &textMessageHandler{out: out, format: format}
+}
+
+func (h *textMessageHandler) Handle(msg FullMessage) error {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return h.format.Format(h.out, msg)
+}
+
+func (h *textMessageHandler) Sync() error {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return syncWriter(h.out)
+}
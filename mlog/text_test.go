@@ -0,0 +1,61 @@
+package mlog
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	. "testing"
+	"time"
+
+	"github.com/mediocregopher/mediocre-go-lib/v2/mctx"
+	"github.com/mediocregopher/mediocre-go-lib/v2/mtest/massert"
+)
+
+func TestTextMessageHandler(t *T) {
+	now := time.Now().UTC()
+	td := now.Format(msgTimeFormat)
+
+	ctx := mctx.Annotate(context.Background(), "b", "2", "a", "1")
+
+	log := func(format TextFormat) string {
+		buf := new(bytes.Buffer)
+		l := NewLogger(&LoggerOpts{
+			MessageHandler: NewTextMessageHandler(buf, format),
+			Now:            func() time.Time { return now },
+		})
+		l.Info(ctx, "foo")
+		l.WithNamespace("x").WithNamespace("y").Info(ctx, "bar,baz")
+		return buf.String()
+	}
+
+	massert.Require(t,
+		massert.Equal(
+			td+"\tINFO\tfoo\ta=1\tb=2\n"+
+				td+"\tINFO\tx/y\tbar,baz\ta=1\tb=2\n",
+			log(TextFormat{}),
+		),
+		massert.Equal(
+			td+",INFO,foo,a:1,b:2\n"+
+				td+`,INFO,x.y,"bar,baz",a:1,b:2`+"\n",
+			log(TextFormat{FieldSep: ",", NamespaceSep: ".", KVSep: ":"}),
+		),
+	)
+
+	// keys containing KVSep, and anything starting with a quote, are quoted
+	ctx = mctx.Annotate(context.Background(), "a=b", "c", "a", "b=c", "q", `"d"`)
+	buf := new(bytes.Buffer)
+	l := NewLogger(&LoggerOpts{
+		MessageHandler: NewTextMessageHandler(buf, TextFormat{}),
+		Now:            func() time.Time { return now },
+	})
+	l.Info(ctx, `"foo"`)
+	exp := strings.Join([]string{
+		td,
+		"INFO",
+		`"\"foo\""`,
+		`a=b=c`,
+		`"a=b"=c`,
+		`q="\"d\""`,
+	}, "\t") + "\n"
+	massert.Require(t, massert.Equal(exp, buf.String()))
+}